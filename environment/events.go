@@ -0,0 +1,44 @@
+package environment
+
+// Structured lifecycle events published on an environment's event bus
+// alongside StateChangeEvent. Where that event only tells a listener the
+// coarse state changed, these carry *why* -- so the panel/websocket layer
+// can show an operator that a server is misbehaving, not just that it went
+// offline. They live here, rather than with any one backend, so every
+// ProcessEnvironment implementation shares the same vocabulary.
+const (
+	ImagePullBackOffEvent = "image pull backoff"
+	CrashLoopBackOffEvent = "crash loop backoff"
+	EvictedEvent          = "evicted"
+	OOMKilledEvent        = "oom killed"
+	ProbeFailedEvent      = "probe failed"
+)
+
+// ImagePullBackOffData is published with ImagePullBackOffEvent.
+type ImagePullBackOffData struct {
+	Image   string
+	Message string
+}
+
+// CrashLoopBackOffData is published with CrashLoopBackOffEvent.
+type CrashLoopBackOffData struct {
+	Container    string
+	RestartCount int32
+}
+
+// EvictedData is published with EvictedEvent.
+type EvictedData struct {
+	Reason  string
+	Message string
+}
+
+// OOMKilledData is published with OOMKilledEvent.
+type OOMKilledData struct {
+	Container   string
+	MemoryLimit int64
+}
+
+// ProbeFailedData is published with ProbeFailedEvent.
+type ProbeFailedData struct {
+	Container string
+}
@@ -0,0 +1,231 @@
+package kubernetes
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"emperror.dev/errors"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// fanoutBufferSize bounds how many outbound chunks a single subscriber may
+// fall behind by before it is treated as stalled and disconnected. This is
+// what lets fanoutWriter.Write stay non-blocking: a subscriber's own pipe
+// write can stall on a backgrounded console tab forever without anyone else
+// noticing, but its channel can only ever fill up to this many chunks deep.
+const fanoutBufferSize = 32
+
+// AttachHub keeps a single exec/attach session open against a pod and fans
+// its stdout/stderr out to any number of subscribers, each getting their own
+// io.Reader, while merging stdin writes from a single designated writer.
+// This lets more than one console viewer attach to the same server without
+// a second viewer stealing the stream from the first or being refused
+// outright.
+type AttachHub struct {
+	exec remotecommand.Executor
+
+	mu     sync.Mutex
+	refs   int
+	stdinW *io.PipeWriter
+
+	subMu  sync.RWMutex
+	subs   map[int]*subscriber
+	nextID int
+}
+
+// subscriber is one fan-out destination: a pipe the caller reads from, and a
+// buffered channel that decouples fanoutWriter.Write from however fast (or
+// slow) this particular subscriber's own pump goroutine can drain it into
+// the pipe.
+type subscriber struct {
+	pw *io.PipeWriter
+	ch chan []byte
+}
+
+// NewAttachHub wraps exec so its stream can be shared by multiple
+// subscribers. The underlying session isn't opened until the first
+// subscriber arrives.
+func NewAttachHub(exec remotecommand.Executor) *AttachHub {
+	return &AttachHub{exec: exec, subs: make(map[int]*subscriber)}
+}
+
+// Subscribe returns an io.Reader that receives a copy of every byte written
+// to the container's stdout/stderr, opening the underlying exec session on
+// the first subscriber. The returned unsubscribe func must be called once
+// the caller is done reading; the underlying session is torn down once the
+// last subscriber leaves.
+func (h *AttachHub) Subscribe() (io.Reader, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pr, pw := io.Pipe()
+	sub := &subscriber{pw: pw, ch: make(chan []byte, fanoutBufferSize)}
+
+	h.subMu.Lock()
+	id := h.nextID
+	h.nextID++
+	h.subs[id] = sub
+	h.subMu.Unlock()
+
+	go h.pump(id, sub)
+
+	if h.refs == 0 {
+		h.start()
+	}
+	h.refs++
+
+	return pr, func() { h.unsubscribe(id) }, nil
+}
+
+// pump drains sub's channel into its pipe for as long as the subscriber
+// stays registered. It runs on its own goroutine per subscriber so that one
+// slow reader only ever stalls its own pipe write, never fanoutWriter.Write
+// or any other subscriber's delivery.
+func (h *AttachHub) pump(id int, sub *subscriber) {
+	for b := range sub.ch {
+		if _, err := sub.pw.Write(b); err != nil {
+			h.evict(id)
+			return
+		}
+	}
+}
+
+// Write implements io.Writer, merging writes from a single designated stdin
+// writer into the underlying exec session. It returns an error if no
+// subscriber has opened the session yet.
+func (h *AttachHub) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	w := h.stdinW
+	h.mu.Unlock()
+
+	if w == nil {
+		return 0, errors.New("kubernetes: attach hub has no active session")
+	}
+	return w.Write(p)
+}
+
+// Close tears down the session immediately, regardless of how many
+// subscribers are still attached.
+func (h *AttachHub) Close() {
+	h.subMu.Lock()
+	for id, sub := range h.subs {
+		sub.pw.Close()
+		close(sub.ch)
+		delete(h.subs, id)
+	}
+	h.subMu.Unlock()
+
+	h.mu.Lock()
+	h.refs = 0
+	h.stopLocked()
+	h.mu.Unlock()
+}
+
+// start opens the exec session in the background. Callers must hold h.mu.
+func (h *AttachHub) start() {
+	pr, pw := io.Pipe()
+	h.stdinW = pw
+
+	go func() {
+		defer pr.Close()
+		_ = h.exec.StreamWithContext(context.Background(), remotecommand.StreamOptions{
+			Stdin:  pr,
+			Stdout: fanoutWriter{h},
+			Stderr: fanoutWriter{h},
+			Tty:    true,
+		})
+	}()
+}
+
+// stopLocked closes the stdin writer, ending the exec session. Callers must
+// hold h.mu.
+func (h *AttachHub) stopLocked() {
+	if h.stdinW != nil {
+		h.stdinW.Close()
+		h.stdinW = nil
+	}
+}
+
+// remove unregisters id, closing its pipe and channel, and reports whether it
+// was still registered. Safe to call more than once for the same id -- only
+// the first caller (whichever of unsubscribe or an evicting pump gets there
+// first) actually tears anything down.
+func (h *AttachHub) remove(id int) bool {
+	h.subMu.Lock()
+	sub, ok := h.subs[id]
+	if ok {
+		delete(h.subs, id)
+	}
+	h.subMu.Unlock()
+
+	if ok {
+		sub.pw.Close()
+		close(sub.ch)
+	}
+	return ok
+}
+
+func (h *AttachHub) unsubscribe(id int) {
+	if !h.remove(id) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refs--
+	if h.refs <= 0 {
+		h.refs = 0
+		h.stopLocked()
+	}
+}
+
+// evict forcibly disconnects the subscriber named id because it fell too far
+// behind to keep up with fanoutWriter.Write, same as if it had unsubscribed
+// itself.
+func (h *AttachHub) evict(id int) {
+	if !h.remove(id) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refs--
+	if h.refs <= 0 {
+		h.refs = 0
+		h.stopLocked()
+	}
+}
+
+// fanoutWriter implements io.Writer over every subscriber currently
+// registered on a hub. Each subscriber has its own buffered channel and pump
+// goroutine, so a slow or gone subscriber never blocks delivery to the
+// others or backpressures the underlying session -- once it falls behind by
+// more than fanoutBufferSize chunks it is disconnected instead.
+type fanoutWriter struct {
+	h *AttachHub
+}
+
+func (f fanoutWriter) Write(p []byte) (int, error) {
+	// Every subscriber gets its own copy: p is owned by the caller
+	// (remotecommand reuses its read buffer across calls), and buffered
+	// channel sends outlive this call.
+	cp := append([]byte(nil), p...)
+
+	f.h.subMu.RLock()
+	var stalled []int
+	for id, sub := range f.h.subs {
+		select {
+		case sub.ch <- cp:
+		default:
+			stalled = append(stalled, id)
+		}
+	}
+	f.h.subMu.RUnlock()
+
+	for _, id := range stalled {
+		f.h.evict(id)
+	}
+
+	return len(p), nil
+}
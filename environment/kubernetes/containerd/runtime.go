@@ -0,0 +1,302 @@
+// Package containerd implements a kubernetes.ContainerRuntime backend that
+// talks directly to a node's containerd instance over its CRI gRPC socket,
+// bypassing the kubelet entirely.
+package containerd
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// ErrContainerNotFound is returned when no container can be resolved for a
+// given server id.
+var ErrContainerNotFound = errors.New("containerd: container not found")
+
+// Runtime is a ContainerRuntime backend that talks directly to containerd
+// over CRI. It keeps a single long-lived gRPC connection open for the life
+// of the process and caches the resolved container handle for each server,
+// so that a state transition (start -> get container -> get task -> wait)
+// doesn't cost a fresh RPC per attribute lookup. This mirrors the
+// libcontainerd overhaul moby shipped to cut down on RPC amplification.
+type Runtime struct {
+	conn *grpc.ClientConn
+	rsvc runtimeapi.RuntimeServiceClient
+
+	mu      sync.RWMutex
+	handles map[string]*handle
+
+	oomMu sync.Mutex
+	oom   map[string]bool // containerID -> seen an OOM event
+}
+
+// handle caches everything we know about a single server's container so that
+// Exists, IsRunning and ExitState don't each have to re-resolve it from the
+// "uuid" label.
+type handle struct {
+	mu          sync.RWMutex
+	containerID string
+	status      *runtimeapi.ContainerStatus
+}
+
+// New dials the containerd CRI socket at the given path and returns a
+// ready-to-use Runtime. The connection is shared by every server handled by
+// this node.
+func New(socket string) (*Runtime, error) {
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, errors.Wrap(err, "containerd: failed to dial CRI socket")
+	}
+
+	r := &Runtime{
+		conn:    conn,
+		rsvc:    runtimeapi.NewRuntimeServiceClient(conn),
+		handles: make(map[string]*handle),
+		oom:     make(map[string]bool),
+	}
+
+	go r.watchOOMEvents()
+
+	return r, nil
+}
+
+// watchOOMEvents consumes the CRI container event stream for the life of the
+// Runtime and remembers which container IDs were stopped with an OOM reason,
+// so ExitState can attribute an OOM kill even if the container status has
+// since been overwritten by a subsequent restart.
+func (r *Runtime) watchOOMEvents() {
+	stream, err := r.rsvc.GetContainerEvents(context.Background(), &runtimeapi.GetEventsRequest{})
+	if err != nil {
+		return
+	}
+
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		if ev.ContainerEventType != runtimeapi.ContainerEventType_CONTAINER_STOPPED_EVENT {
+			continue
+		}
+		if ev.ContainerStatus != nil && ev.ContainerStatus.Reason == "OOMKilled" {
+			r.oomMu.Lock()
+			r.oom[ev.ContainerId] = true
+			r.oomMu.Unlock()
+		}
+	}
+}
+
+func (r *Runtime) wasOOMKilled(containerID string) bool {
+	r.oomMu.Lock()
+	defer r.oomMu.Unlock()
+	return r.oom[containerID]
+}
+
+// resolve returns the cached handle for id, resolving and caching it from
+// the CRI ListContainers API on first use.
+func (r *Runtime) resolve(ctx context.Context, id string) (*handle, error) {
+	r.mu.RLock()
+	h, ok := r.handles[id]
+	r.mu.RUnlock()
+	if ok {
+		return h, nil
+	}
+
+	resp, err := r.rsvc.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{LabelSelector: map[string]string{"uuid": id}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "containerd: failed to list containers")
+	}
+	if len(resp.Containers) == 0 {
+		return nil, ErrContainerNotFound
+	}
+
+	h = &handle{containerID: resp.Containers[0].Id}
+
+	r.mu.Lock()
+	r.handles[id] = h
+	r.mu.Unlock()
+
+	return h, nil
+}
+
+// forget evicts the cached handle for id, used once a container has exited
+// for good so a future lookup re-resolves rather than serving a stale task.
+// It also drops id's entry from the OOM event cache -- keyed by the
+// underlying containerID, not id -- so that map doesn't grow by one entry
+// for every container that was ever OOM-killed over the life of the process.
+func (r *Runtime) forget(id string) {
+	r.mu.Lock()
+	h, ok := r.handles[id]
+	delete(r.handles, id)
+	r.mu.Unlock()
+
+	if ok {
+		r.oomMu.Lock()
+		delete(r.oom, h.containerID)
+		r.oomMu.Unlock()
+	}
+}
+
+// status fetches the container's current status from CRI with a single
+// ContainerStatus call against the cached container ID, and stores it on the
+// handle.
+func (h *handle) status(ctx context.Context, rsvc runtimeapi.RuntimeServiceClient) (*runtimeapi.ContainerStatus, error) {
+	resp, err := rsvc.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: h.containerID})
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	h.status = resp.Status
+	h.mu.Unlock()
+
+	return resp.Status, nil
+}
+
+func (r *Runtime) Exists(ctx context.Context, id string) (bool, error) {
+	_, err := r.resolve(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrContainerNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *Runtime) IsRunning(ctx context.Context, id string) (bool, error) {
+	h, err := r.resolve(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	st, err := h.status(ctx, r.rsvc)
+	if err != nil {
+		return false, err
+	}
+
+	return st.State == runtimeapi.ContainerState_CONTAINER_RUNNING, nil
+}
+
+func (r *Runtime) ExitState(ctx context.Context, id string) (uint32, bool, string, error) {
+	h, err := r.resolve(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrContainerNotFound) {
+			return 1, false, "", nil
+		}
+		return 0, false, "", err
+	}
+
+	st, err := h.status(ctx, r.rsvc)
+	if err != nil {
+		return 0, false, "", err
+	}
+
+	// An ExitCode of 137 on its own just means SIGKILL, which a plain stop or
+	// liveness-probe kill also produces. Trust the status reason, falling
+	// back to the OOM event stream in case the status was already
+	// overwritten by the time we looked.
+	oom := st.Reason == "OOMKilled" || r.wasOOMKilled(h.containerID)
+
+	// The task has already exited for good; drop the cached handle so the
+	// next start resolves a fresh container rather than reusing this one.
+	if st.State == runtimeapi.ContainerState_CONTAINER_EXITED {
+		r.forget(id)
+	}
+
+	return uint32(st.ExitCode), oom, st.Metadata.Name, nil
+}
+
+// Attach opens an exec session against the container over CRI's Attach RPC
+// and wraps the returned streaming URL in the same websocket executor
+// client-go uses for kubelet exec sessions, so callers see no difference
+// between backends.
+func (r *Runtime) Attach(ctx context.Context, id string) (remotecommand.Executor, error) {
+	h, err := r.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.rsvc.Attach(ctx, &runtimeapi.AttachRequest{
+		ContainerId: h.containerID,
+		Stdin:       true,
+		Stdout:      true,
+		Stderr:      true,
+		Tty:         true,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "containerd: failed to open attach stream")
+	}
+
+	// The CRI streaming URL points straight at containerd's own streaming
+	// server on this node, not through the kube-apiserver proxy -- there's no
+	// bearer token or client cert to carry over from anywhere, since the
+	// Runtime only ever holds a raw gRPC connection to the CRI socket. This
+	// is just enough of a rest.Config for the executor to build its
+	// websocket dialer against that bare endpoint.
+	streamConfig := &rest.Config{TLSClientConfig: rest.TLSClientConfig{Insecure: true}}
+
+	return remotecommand.NewWebSocketExecutor(streamConfig, "GET", resp.Url)
+}
+
+// statsPollInterval is how often Stats re-polls ContainerStats while its
+// pipe stays open, since CRI has no equivalent to the kubelet's long-lived
+// stats endpoint to stream from directly.
+const statsPollInterval = 2 * time.Second
+
+// Stats opens a stats stream for the container backing id. It polls
+// ContainerStats on a ticker and writes each sample into a pipe, so callers
+// see the same long-lived io.ReadCloser contract the kubelet-backed runtime
+// exposes rather than a single sample followed by EOF. The poll loop exits,
+// closing the pipe, once ctx is done or the reader side is closed.
+func (r *Runtime) Stats(ctx context.Context, id string) (io.ReadCloser, error) {
+	h, err := r.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer pw.Close()
+
+		ticker := time.NewTicker(statsPollInterval)
+		defer ticker.Stop()
+
+		for {
+			resp, err := r.rsvc.ContainerStats(ctx, &runtimeapi.ContainerStatsRequest{ContainerId: h.containerID})
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write([]byte(resp.String() + "\n")); err != nil {
+				// The reader side closed; nothing left to poll for.
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return pr, nil
+}
+
+func (r *Runtime) PullImage(ctx context.Context, id, image string) error {
+	_, err := r.rsvc.PullImage(ctx, &runtimeapi.PullImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: image},
+	})
+	return errors.Wrap(err, "containerd: failed to pull image")
+}
@@ -9,7 +9,6 @@ import (
 	"emperror.dev/errors"
 	"github.com/apex/log"
 	v1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -31,6 +30,10 @@ type Metadata struct {
 // from the base environment interface.
 var _ environment.ProcessEnvironment = (*Environment)(nil)
 
+// Ensure the environment can always register itself against the shared pod
+// watcher.
+var _ podListener = (*Environment)(nil)
+
 type Environment struct {
 	mu sync.RWMutex
 
@@ -47,9 +50,16 @@ type Environment struct {
 	config *rest.Config
 	client *kubernetes.Clientset
 
-	// Controls the hijacked response stream which exists only when we're attached to
-	// the running container instance.
-	stream remotecommand.Executor
+	// The backend responsible for actually carrying out pod/container
+	// lifecycle operations. Defaults to talking to the Kubernetes API (and
+	// therefore the kubelet), but can be swapped for a runtime that talks
+	// directly to the node's container runtime.
+	runtime ContainerRuntime
+
+	// The attach hub multiplexing the hijacked response stream across every
+	// subscriber currently attached to the running container instance. Nil
+	// whenever nothing is attached.
+	hub *AttachHub
 
 	// Holds the stats stream used by the polling commands so that we can easily close it out.
 	stats io.ReadCloser
@@ -61,6 +71,17 @@ type Environment struct {
 
 	// Tracks the environment state.
 	st *system.AtomicString
+
+	// unsubscribe deregisters this environment from the shared pod watcher.
+	// It is called from Close() so a stopped server stops receiving events.
+	unsubscribe func()
+
+	// eventsMu guards the previously-observed pod state below, letting
+	// publishPodEvents tell a genuinely new transition apart from the
+	// kubelet simply re-reporting an ongoing condition.
+	eventsMu       sync.Mutex
+	prevEvicted    bool
+	prevContainers map[string]containerObservation
 }
 
 // New creates a new base Kubernetes environment. The ID passed through will be the
@@ -83,9 +104,45 @@ func New(id string, m *Metadata, c *environment.Configuration) (*Environment, er
 		emitter:       events.NewBus(),
 	}
 
+	rt, err := newRuntime(config, cli)
+	if err != nil {
+		return nil, err
+	}
+	e.runtime = rt
+	e.unsubscribe = sharedPodWatcher(cli).subscribe(id, e)
+
 	return e, nil
 }
 
+// Close deregisters this environment from the shared pod watcher. It should
+// be called once a server is no longer managed by this node so it stops
+// receiving pod callbacks for an id that may be reused later.
+func (e *Environment) Close() {
+	e.unsubscribe()
+}
+
+// onPodUpdate is called by the shared podWatcher whenever the pod backing
+// this environment is added or updated. It keeps e.st in sync with the
+// pod's phase without this environment ever having to poll for it.
+func (e *Environment) onPodUpdate(pod *v1.Pod) {
+	switch pod.Status.Phase {
+	case v1.PodPending:
+		e.SetState(environment.ProcessStartingState)
+	case v1.PodRunning:
+		e.SetState(environment.ProcessRunningState)
+	case v1.PodSucceeded, v1.PodFailed:
+		e.SetState(environment.ProcessOfflineState)
+	}
+
+	e.publishPodEvents(pod)
+}
+
+// onPodDelete is called by the shared podWatcher once the pod backing this
+// environment has been removed entirely.
+func (e *Environment) onPodDelete() {
+	e.SetState(environment.ProcessOfflineState)
+}
+
 func (e *Environment) GetServiceDetails() []v1.Service {
 	list, err := e.client.CoreV1().Services(config.Get().Cluster.Namespace).List(context.TODO(), metav1.ListOptions{
 		LabelSelector: "uuid=" + e.Id,
@@ -108,18 +165,55 @@ func (e *Environment) Type() string {
 // SetStream sets the current stream value from the Docker client. If a nil
 // value is provided we assume that the stream is no longer operational and the
 // instance is effectively offline.
+//
+// The executor is wrapped in an AttachHub so any number of console viewers
+// can subscribe to it concurrently instead of stealing it from one another.
 func (e *Environment) SetStream(s remotecommand.Executor) {
 	e.mu.Lock()
-	e.stream = s
+	if e.hub != nil {
+		e.hub.Close()
+		e.hub = nil
+	}
+	if s != nil {
+		e.hub = NewAttachHub(s)
+	}
+	hub := e.hub
 	e.mu.Unlock()
+
+	if hub == nil {
+		return
+	}
+
+	e.logCallbackMx.Lock()
+	cb := e.logCallback
+	e.logCallbackMx.Unlock()
+	if cb != nil {
+		e.subscribeLogCallback(hub, cb)
+	}
 }
 
 // IsAttached determines if this process is currently attached to the
-// container instance by checking if the stream is nil or not.
+// container instance by checking if the hub is nil or not.
 func (e *Environment) IsAttached() bool {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
-	return e.stream != nil
+	return e.hub != nil
+}
+
+// Attach subscribes to the environment's AttachHub, returning a reader that
+// receives a copy of the container's combined stdout/stderr and an
+// unsubscribe func the caller must invoke once done reading. It returns an
+// error if nothing is currently attached.
+func (e *Environment) Attach() (io.Reader, func(), error) {
+	e.mu.RLock()
+	hub := e.hub
+	e.mu.RUnlock()
+
+	if hub == nil {
+		return nil, nil, errors.New("kubernetes: environment is not attached")
+	}
+
+	return hub.Subscribe()
 }
 
 // Events returns an event bus for the environment.
@@ -133,16 +227,7 @@ func (e *Environment) Events() *events.Bus {
 // name as the lookup parameter in addition to the longer ID auto-assigned when
 // the container is created.
 func (e *Environment) Exists() (bool, error) {
-	_, err := e.client.CoreV1().Pods(config.Get().Cluster.Namespace).Get(context.Background(), e.Id, metav1.GetOptions{})
-	if err != nil {
-		// If this error is because the container instance wasn't found via Docker we
-		// can safely ignore the error and just return false.
-		if apierrors.IsNotFound(err) {
-			return false, nil
-		}
-		return false, err
-	}
-	return true, nil
+	return e.runtime.Exists(context.Background(), e.Id)
 }
 
 // IsRunning determines if the server's docker container is currently running.
@@ -155,21 +240,41 @@ func (e *Environment) Exists() (bool, error) {
 //
 // @see docker/client/errors.go
 func (e *Environment) IsRunning(ctx context.Context) (bool, error) {
-	c, err := e.client.CoreV1().Pods(config.Get().Cluster.Namespace).Get(ctx, e.Id, metav1.GetOptions{})
-	if err != nil {
-		return false, err
-	}
-	if c.Status.Phase == v1.PodRunning {
-		return true, nil
+	return e.runtime.IsRunning(ctx, e.Id)
+}
+
+// ExitState returns the exit code of the container that exited, its name,
+// and whether or not it was killed by the OOM killer.
+func (e *Environment) ExitState() (code uint32, oom bool, container string, err error) {
+	return e.runtime.ExitState(context.Background(), e.Id)
+}
+
+// podExists determines if the pod backing id currently exists, reading
+// straight from the shared informer's local cache instead of asking the API
+// server.
+func podExists(w *podWatcher, id string) (bool, error) {
+	_, ok := w.getPod(id)
+	return ok, nil
+}
+
+// podIsRunning determines if the pod backing id is currently running,
+// reading straight from the shared informer's local cache.
+func podIsRunning(w *podWatcher, id string) (bool, error) {
+	c, ok := w.getPod(id)
+	if !ok {
+		return false, nil
 	}
-	return false, nil
+	return c.Status.Phase == v1.PodRunning, nil
 }
 
-// ExitState returns the container exit state, the exit code and whether or not
-// the container was killed by the OOM killer.
-func (e *Environment) ExitState() (uint32, bool, error) {
-	c, err := e.client.CoreV1().Pods(config.Get().Cluster.Namespace).Get(context.Background(), e.Id, metav1.GetOptions{})
-	if err != nil {
+// podExitState returns the exit code, OOM status and name of whichever
+// container in the pod backing id actually terminated. We used to assume it
+// was always ContainerStatuses[0], but a pod can (and in practice does)
+// report more than one container status, so this walks all of them looking
+// for the one that's terminated.
+func podExitState(w *podWatcher, id string) (uint32, bool, string, error) {
+	c, ok := w.getPod(id)
+	if !ok {
 		// I'm not entirely sure how this can happen to be honest. I tried deleting a
 		// container _while_ a server was running and kuber gracefully saw the crash and
 		// created a new container for it.
@@ -179,41 +284,60 @@ func (e *Environment) ExitState() (uint32, bool, error) {
 		// so that's a mystery that will have to go unsolved.
 		//
 		// @see https://github.com/pterodactyl/panel/issues/2003
-		if apierrors.IsNotFound(err) {
-			return 1, false, nil
-		}
-		return 0, false, err
+		return 1, false, "", nil
 	}
 
-	if len(c.Status.ContainerStatuses) != 0 {
-		if c.Status.ContainerStatuses[0].State.Terminated != nil {
-			// OOMKilled
-			if c.Status.ContainerStatuses[0].State.Terminated.ExitCode == 137 {
-				return 137, true, nil
-			}
+	for _, cs := range c.Status.ContainerStatuses {
+		if cs.State.Terminated == nil {
+			continue
+		}
 
-			return uint32(c.Status.ContainerStatuses[0].State.Terminated.ExitCode), false, nil
+		// An ExitCode of 137 just means the process was killed by SIGKILL -- a
+		// stop signal, a `kubectl delete`, or a failed liveness probe all end up
+		// here too. Only trust the reason kubelet actually attaches to the
+		// (last) termination when deciding this was an OOM kill.
+		oom := cs.State.Terminated.Reason == "OOMKilled"
+		if !oom && cs.LastTerminationState.Terminated != nil {
+			oom = cs.LastTerminationState.Terminated.Reason == "OOMKilled"
 		}
+
+		return uint32(cs.State.Terminated.ExitCode), oom, cs.Name, nil
 	}
-	return 1, false, nil
+
+	return 1, false, "", nil
+}
+
+// Config returns a copy of the environment configuration. Like Meta, this is
+// safe to call from any goroutine; unlike the pointer this used to hand out,
+// mutating the returned value can no longer race with a concurrent reader
+// taking its own copy.
+func (e *Environment) Config() environment.Configuration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return *e.Configuration
 }
 
-// Config returns the environment configuration allowing a process to make
-// modifications of the environment on the fly.
-func (e *Environment) Config() *environment.Configuration {
+// Meta returns a copy of the environment's metadata (the configured image
+// and stop configuration). Unlike reaching into the unexported meta field
+// directly, this is safe to call from any goroutine.
+func (e *Environment) Meta() Metadata {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
-	return e.Configuration
+	return *e.meta
 }
 
-// SetStopConfiguration sets the stop configuration for the environment.
+// SetStopConfiguration sets the stop configuration for the environment. Use
+// Meta() to read it back safely.
 func (e *Environment) SetStopConfiguration(c remote.ProcessStopConfiguration) {
 	e.mu.Lock()
 	e.meta.Stop = c
 	e.mu.Unlock()
 }
 
+// SetImage sets the image that will be used for this environment. Use Meta()
+// to read it back safely.
 func (e *Environment) SetImage(i string) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -244,9 +368,46 @@ func (e *Environment) SetState(state string) {
 	}
 }
 
+// SetLogCallback registers f to receive a copy of everything the container
+// writes to stdout/stderr while attached. Internally this is just one more
+// subscriber on top of the environment's AttachHub, same as any console
+// viewer.
 func (e *Environment) SetLogCallback(f func([]byte)) {
 	e.logCallbackMx.Lock()
-	defer e.logCallbackMx.Unlock()
-
 	e.logCallback = f
+	e.logCallbackMx.Unlock()
+
+	e.mu.RLock()
+	hub := e.hub
+	e.mu.RUnlock()
+	if f != nil && hub != nil {
+		e.subscribeLogCallback(hub, f)
+	}
+}
+
+// subscribeLogCallback subscribes f to hub and runs it for as long as that
+// hub stays open. The caller is responsible for resolving hub -- this never
+// touches e.mu itself; callers like SetStream read hub under e.mu and
+// release it before calling this.
+func (e *Environment) subscribeLogCallback(hub *AttachHub, f func([]byte)) {
+	r, unsubscribe, err := hub.Subscribe()
+	if err != nil {
+		e.log().WithError(err).Warn("failed to subscribe log callback to attach hub")
+		return
+	}
+
+	go func() {
+		defer unsubscribe()
+
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				f(append([]byte(nil), buf[:n]...))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
 }
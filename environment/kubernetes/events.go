@@ -0,0 +1,104 @@
+package kubernetes
+
+import (
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/kubectyl/kuber/environment"
+)
+
+// containerObservation is the slice of a container's status we remember
+// between calls to publishPodEvents, so it can tell a genuinely new
+// transition apart from the kubelet simply re-reporting the same ongoing
+// condition on its next periodic status refresh.
+type containerObservation struct {
+	ready                 bool
+	waitingReason         string
+	terminatedFingerprint string
+}
+
+// publishPodEvents compares pod against whatever was last observed for this
+// environment and publishes only the transitions that are new, as one of the
+// structured events defined in the environment package alongside
+// environment.StateChangeEvent. It's called from onPodUpdate on every pod
+// change the shared watcher sees, including periodic kubelet status
+// refreshes that don't represent a real transition, so without this
+// bookkeeping every one of those would re-publish whatever condition
+// happens to still be true.
+func (e *Environment) publishPodEvents(pod *v1.Pod) {
+	e.eventsMu.Lock()
+	defer e.eventsMu.Unlock()
+
+	evicted := pod.Status.Reason == "Evicted"
+	if evicted && !e.prevEvicted {
+		e.Events().Publish(environment.EvictedEvent, environment.EvictedData{
+			Reason:  pod.Status.Reason,
+			Message: pod.Status.Message,
+		})
+	}
+	e.prevEvicted = evicted
+
+	if e.prevContainers == nil {
+		e.prevContainers = make(map[string]containerObservation)
+	}
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		prev := e.prevContainers[cs.Name]
+		obs := containerObservation{ready: cs.Ready}
+
+		if w := cs.State.Waiting; w != nil {
+			obs.waitingReason = w.Reason
+			if w.Reason != prev.waitingReason {
+				switch w.Reason {
+				case "ImagePullBackOff", "ErrImagePull":
+					e.Events().Publish(environment.ImagePullBackOffEvent, environment.ImagePullBackOffData{
+						Image:   cs.Image,
+						Message: w.Message,
+					})
+				case "CrashLoopBackOff":
+					e.Events().Publish(environment.CrashLoopBackOffEvent, environment.CrashLoopBackOffData{
+						Container:    cs.Name,
+						RestartCount: cs.RestartCount,
+					})
+				}
+			}
+		}
+
+		if t := cs.State.Terminated; t != nil && t.Reason == "OOMKilled" {
+			// StartedAt/FinishedAt uniquely identify a single termination, so
+			// this still catches a second OOM kill on a restarted container
+			// instead of only ever firing once for the container's lifetime.
+			obs.terminatedFingerprint = t.StartedAt.String() + "/" + t.FinishedAt.String()
+			if obs.terminatedFingerprint != prev.terminatedFingerprint {
+				e.Events().Publish(environment.OOMKilledEvent, environment.OOMKilledData{
+					Container:   cs.Name,
+					MemoryLimit: containerMemoryLimit(pod, cs.Name),
+				})
+			}
+		}
+
+		// A probe failure looks like a container that was already running
+		// and ready flipping to not-ready. That's distinct from
+		// ContainersReady=False/ContainersNotReady on a brand new pod, which
+		// is just every server's normal state between creation and its first
+		// successful readiness check.
+		if cs.State.Running != nil && prev.ready && !cs.Ready {
+			e.Events().Publish(environment.ProbeFailedEvent, environment.ProbeFailedData{Container: cs.Name})
+		}
+
+		e.prevContainers[cs.Name] = obs
+	}
+}
+
+// containerMemoryLimit returns the memory limit (in bytes) configured for
+// the named container, or 0 if none was found.
+func containerMemoryLimit(pod *v1.Pod, container string) int64 {
+	for _, c := range pod.Spec.Containers {
+		if c.Name != container {
+			continue
+		}
+		if limit, ok := c.Resources.Limits[v1.ResourceMemory]; ok {
+			return limit.Value()
+		}
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubectyl/kuber/config"
+)
+
+// podListener receives callbacks from the shared podWatcher for a single
+// pod. Environments register themselves as a podListener so their hot-path
+// lookups (Exists, IsRunning, ExitState) and state tracking are driven off
+// the informer's local cache instead of hitting the API server directly.
+type podListener interface {
+	onPodUpdate(pod *v1.Pod)
+	onPodDelete()
+}
+
+// podWatcher wraps a single SharedIndexInformer over every kuber-managed pod
+// in the configured namespace, and fans Add/Update/Delete callbacks out to
+// whichever Environment registered interest in a given pod's name. There is
+// one of these per process -- every Environment shares it -- so a node
+// running dozens of servers issues one watch against the API server instead
+// of hammering it with a Get per server per hot-path call.
+type podWatcher struct {
+	informer cache.SharedIndexInformer
+
+	mu        sync.RWMutex
+	listeners map[string]podListener
+}
+
+var (
+	watcherOnce sync.Once
+	watcher     *podWatcher
+)
+
+// sharedPodWatcher starts (once, for the life of the process) the informer
+// backing every Environment's pod lookups, and returns it.
+func sharedPodWatcher(cli *kubernetes.Clientset) *podWatcher {
+	watcherOnce.Do(func() {
+		namespace := config.Get().Cluster.Namespace
+
+		lw := &cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				opts.LabelSelector = "uuid"
+				return cli.CoreV1().Pods(namespace).List(context.Background(), opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				opts.LabelSelector = "uuid"
+				return cli.CoreV1().Pods(namespace).Watch(context.Background(), opts)
+			},
+		}
+
+		w := &podWatcher{
+			informer:  cache.NewSharedIndexInformer(lw, &v1.Pod{}, 0, cache.Indexers{}),
+			listeners: make(map[string]podListener),
+		}
+
+		w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    w.dispatchUpdate,
+			UpdateFunc: func(_, obj interface{}) { w.dispatchUpdate(obj) },
+			DeleteFunc: w.dispatchDelete,
+		})
+
+		stop := make(chan struct{})
+		go w.informer.Run(stop)
+		cache.WaitForCacheSync(stop, w.informer.HasSynced)
+
+		watcher = w
+	})
+
+	return watcher
+}
+
+func (w *podWatcher) dispatchUpdate(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	w.mu.RLock()
+	l, ok := w.listeners[pod.Name]
+	w.mu.RUnlock()
+	if ok {
+		l.onPodUpdate(pod)
+	}
+}
+
+func (w *podWatcher) dispatchDelete(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		pod, ok = tombstone.Obj.(*v1.Pod)
+		if !ok {
+			return
+		}
+	}
+
+	w.mu.RLock()
+	l, ok := w.listeners[pod.Name]
+	w.mu.RUnlock()
+	if ok {
+		l.onPodDelete()
+	}
+}
+
+// subscribe registers l to receive callbacks for the pod named id, returning
+// an unsubscribe func. Callers must invoke it once they are no longer
+// interested (e.g. the server backing this listener has been deleted) so
+// that stopped servers stop receiving events.
+//
+// Since the informer's initial list-driven Add replay only reaches whatever
+// listeners were already registered at the time it ran, every Environment
+// constructed after the first one would otherwise subscribe against an
+// already-synced watcher and never learn the current state of a pod that
+// existed before it subscribed. To avoid that, subscribe seeds l with
+// whatever is already cached for id before returning.
+func (w *podWatcher) subscribe(id string, l podListener) func() {
+	w.mu.Lock()
+	w.listeners[id] = l
+	w.mu.Unlock()
+
+	if pod, ok := w.getPod(id); ok {
+		l.onPodUpdate(pod)
+	}
+
+	return func() {
+		w.mu.Lock()
+		delete(w.listeners, id)
+		w.mu.Unlock()
+	}
+}
+
+// getPod returns the cached pod named id without making an API call.
+func (w *podWatcher) getPod(id string) (*v1.Pod, bool) {
+	obj, exists, err := w.informer.GetStore().GetByKey(config.Get().Cluster.Namespace + "/" + id)
+	if err != nil || !exists {
+		return nil, false
+	}
+
+	pod, ok := obj.(*v1.Pod)
+	return pod, ok
+}